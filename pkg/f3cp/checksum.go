@@ -0,0 +1,77 @@
+package f3cp
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// ErrChecksumMismatch is wrapped into the error a verifyingReader returns in
+// place of io.EOF when the bytes it streamed don't match the checksum they
+// were supposed to have.
+var ErrChecksumMismatch = errors.New("f3cp: checksum mismatch")
+
+// newHash returns the hash.Hash fedora uses for the given DsInfo
+// ChecksumType ("MD5", "SHA-1", "SHA-256", "SHA-512").
+func newHash(checksumType string) (hash.Hash, error) {
+	switch strings.ToUpper(checksumType) {
+	case "MD5":
+		return md5.New(), nil
+	case "SHA-1", "SHA1":
+		return sha1.New(), nil
+	case "SHA-256", "SHA256":
+		return sha256.New(), nil
+	case "SHA-512", "SHA512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("f3cp: unsupported checksum type %q", checksumType)
+	}
+}
+
+// verifyingReader hashes every byte read from r. Once r reports EOF, it
+// compares the accumulated digest against want and, if they disagree,
+// returns ErrChecksumMismatch instead of EOF, so any consumer that treats a
+// non-EOF error as failure (io.Copy, an http.Request body, our own
+// writeJSONBase64String) sees the corruption rather than treating a
+// truncated or altered stream as having completed successfully.
+type verifyingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want string
+}
+
+// newVerifyingReader wraps r so its content is checked against checksum
+// (hashed with the algorithm named by checksumType) as it is streamed
+// through. If checksum is empty, or checksumType is "DISABLED" -- fedora's
+// way of saying no checksum is configured for this datastream -- r is
+// returned unwrapped.
+func newVerifyingReader(r io.Reader, checksumType, checksum string) (io.Reader, error) {
+	if checksum == "" || strings.EqualFold(checksumType, "DISABLED") {
+		return r, nil
+	}
+	h, err := newHash(checksumType)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{r: r, h: h, want: checksum}, nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if n > 0 {
+		v.h.Write(p[:n])
+	}
+	if err == io.EOF {
+		if got := hex.EncodeToString(v.h.Sum(nil)); !strings.EqualFold(got, v.want) {
+			return n, fmt.Errorf("%w: got %s, want %s", ErrChecksumMismatch, got, v.want)
+		}
+	}
+	return n, err
+}
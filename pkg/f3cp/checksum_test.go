@@ -0,0 +1,48 @@
+package f3cp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestVerifyingReaderMatch(t *testing.T) {
+	want := []byte("hello, fedora")
+	sum := sha256.Sum256(want)
+
+	r, err := newVerifyingReader(bytes.NewReader(want), "SHA-256", hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatalf("newVerifyingReader: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("content = %q, want %q", got, want)
+	}
+}
+
+func TestVerifyingReaderMismatch(t *testing.T) {
+	r, err := newVerifyingReader(bytes.NewReader([]byte("tampered content")), "SHA-256", hex.EncodeToString(make([]byte, 32)))
+	if err != nil {
+		t.Fatalf("newVerifyingReader: %v", err)
+	}
+	_, err = io.ReadAll(r)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("ReadAll err = %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestVerifyingReaderDisabled(t *testing.T) {
+	r, err := newVerifyingReader(bytes.NewReader([]byte("anything")), "DISABLED", "")
+	if err != nil {
+		t.Fatalf("newVerifyingReader: %v", err)
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package f3cp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dbrower/f3cp/pkg/fedora"
+)
+
+// Export writes each of ids as a BagIt-like directory tree under dir:
+//
+//	dir/objects/<pid>/object.json                 -- ObjectInfo
+//	dir/objects/<pid>/datastreams/<name>.json      -- DsInfo
+//	dir/objects/<pid>/datastreams/<name>.xml|.bin  -- raw datastream content
+//	dir/manifest-sha256.txt                        -- sha256 of every file above
+//
+// where <pid> is the pid as rewritten by sanitizePID.
+//
+// Unlike the single JSON array dump produces, this layout is meant to be
+// grepped, diffed with ordinary tools, and hand-edited one datastream at a
+// time; manifest-sha256.txt makes the result self-validating, the same way
+// a BagIt manifest does.
+func Export(ctx context.Context, remote *fedora.RemoteFedora, dir string, ids []string, verify bool) error {
+	var manifest []manifestEntry
+	for _, id := range ids {
+		fmt.Fprintln(os.Stderr, "exporting", id)
+		obj, err := FetchOneObject(ctx, remote, id)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, id, err)
+			continue
+		}
+		entries, err := exportObject(ctx, remote, dir, obj, verify)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, id, err)
+			continue
+		}
+		manifest = append(manifest, entries...)
+	}
+	return writeSHA256Manifest(dir, manifest)
+}
+
+// manifestEntry is one line of manifest-sha256.txt: a file's path relative
+// to the export directory, and its digest.
+type manifestEntry struct {
+	path   string
+	sha256 string
+}
+
+func exportObject(ctx context.Context, remote *fedora.RemoteFedora, dir string, obj *FObject, verify bool) ([]manifestEntry, error) {
+	objDir := filepath.Join("objects", sanitizePID(obj.PID))
+	if err := os.MkdirAll(filepath.Join(dir, objDir, "datastreams"), 0777); err != nil {
+		return nil, err
+	}
+
+	var entries []manifestEntry
+
+	infoPath := filepath.Join(objDir, "object.json")
+	sum, err := writeJSONFile(filepath.Join(dir, infoPath), obj.ObjectInfo)
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, manifestEntry{infoPath, sum})
+
+	for _, ds := range obj.DSitems {
+		dsInfoPath := filepath.Join(objDir, "datastreams", ds.Name+".json")
+		sum, err := writeJSONFile(filepath.Join(dir, dsInfoPath), ds.DsInfo)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, manifestEntry{dsInfoPath, sum})
+
+		if ds.Size == 0 {
+			continue
+		}
+		contentPath, sum, err := exportDatastreamContent(ctx, remote, dir, objDir, obj.PID, ds, verify)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, manifestEntry{contentPath, sum})
+	}
+	return entries, nil
+}
+
+func writeJSONFile(path string, v interface{}) (string, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := atomicWriteFile(path, data); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// exportDatastreamContent fetches ds's content from remote and streams it
+// straight to a file, picking ".xml" for valid UTF-8 text and ".bin"
+// otherwise, since the whole point of this layout is raw, unwrapped bytes
+// rather than base64. It returns the file's path (relative to dir) and its
+// sha256 digest, computed as the content is written.
+func exportDatastreamContent(ctx context.Context, remote *fedora.RemoteFedora, dir, objDir, pid string, ds DSentry, verify bool) (string, string, error) {
+	body, err := remote.GetDatastream(ctx, pid, ds.Name)
+	if err != nil {
+		return "", "", err
+	}
+	defer body.Close()
+
+	isText, content, err := sniffUTF8(body)
+	if err != nil {
+		return "", "", err
+	}
+	content = io.LimitReader(content, ds.Size)
+	if verify {
+		content, err = newVerifyingReader(content, ds.ChecksumType, ds.Checksum)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	ext := ".bin"
+	if isText {
+		ext = ".xml"
+	}
+	relPath := filepath.Join(objDir, "datastreams", ds.Name+ext)
+	fullPath := filepath.Join(dir, relPath)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fullPath), ds.Name+".tmp")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), content); err != nil {
+		tmp.Close()
+		return "", "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", "", err
+	}
+	if err := os.Rename(tmp.Name(), fullPath); err != nil {
+		return "", "", err
+	}
+	return relPath, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeSHA256Manifest(dir string, entries []manifestEntry) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	var buf strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "%s  %s\n", e.sha256, e.path)
+	}
+	return atomicWriteFile(filepath.Join(dir, "manifest-sha256.txt"), []byte(buf.String()))
+}
+
+// Import reads the directory tree written by Export and uploads it to
+// remote, streaming each datastream straight from its file on disk into
+// MakeDatastream/UpdateDatastream.
+func Import(ctx context.Context, remote *fedora.RemoteFedora, dir string, verify bool) error {
+	pidDirs, err := ioutil.ReadDir(filepath.Join(dir, "objects"))
+	if err != nil {
+		return err
+	}
+	for _, pidDir := range pidDirs {
+		if !pidDir.IsDir() {
+			continue
+		}
+		objDir := filepath.Join(dir, "objects", pidDir.Name())
+		if err := importObject(ctx, remote, objDir, verify); err != nil {
+			fmt.Fprintln(os.Stderr, pidDir.Name(), err)
+		}
+	}
+	return nil
+}
+
+func importObject(ctx context.Context, remote *fedora.RemoteFedora, objDir string, verify bool) error {
+	var info fedora.ObjectInfo
+	if err := readJSONFile(filepath.Join(objDir, "object.json"), &info); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "importing", info.PID)
+	if err := ensureObject(ctx, remote, info); err != nil {
+		return err
+	}
+
+	dsDir := filepath.Join(objDir, "datastreams")
+	files, err := ioutil.ReadDir(dsDir)
+	if err != nil {
+		return err
+	}
+
+	// datastream metadata and content files share a base name (the
+	// datastream's name); pair them up before uploading anything.
+	dsInfos := map[string]fedora.DsInfo{}
+	contentPaths := map[string]string{}
+	for _, f := range files {
+		name := f.Name()
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		if strings.HasSuffix(name, ".json") {
+			var info fedora.DsInfo
+			if err := readJSONFile(filepath.Join(dsDir, name), &info); err != nil {
+				return err
+			}
+			dsInfos[base] = info
+		} else {
+			contentPaths[base] = filepath.Join(dsDir, name)
+		}
+	}
+
+	var names []string
+	for base := range dsInfos {
+		names = append(names, base)
+	}
+	sort.Strings(names)
+
+	for _, base := range names {
+		dsInfo := dsInfos[base]
+		if dsInfo.Name == "DC" {
+			continue
+		}
+		var source io.Reader
+		var f *os.File
+		if path, ok := contentPaths[base]; ok {
+			f, err = os.Open(path)
+			if err != nil {
+				return err
+			}
+			source = f
+		}
+		err := uploadDatastream(ctx, remote, info.PID, dsInfo, source, verify)
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readJSONFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,90 @@
+package f3cp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dbrower/f3cp/pkg/fedora"
+)
+
+// TestExportImportRoundTrip exports an object to a directory tree, checks
+// its layout and manifest, then imports that same tree into a second, empty
+// fakeFedora and checks the uploaded object and datastream match the
+// original.
+func TestExportImportRoundTrip(t *testing.T) {
+	src, srcRemote := newFakeFedora(t)
+	const pid = "test:export"
+	src.put(fedora.ObjectInfo{PID: pid, Label: "a test object", MDate: "2020-01-01T00:00:00Z"})
+	src.putDatastream(pid, fedora.DsInfo{Name: "TEXT", MIMEType: "text/plain"}, []byte("hello, export"))
+	src.putDatastream(pid, fedora.DsInfo{Name: "BIN", MIMEType: "application/octet-stream"}, []byte{0x00, 0xff, 0x10, 0x20})
+
+	dir := t.TempDir()
+	if err := Export(context.Background(), srcRemote, dir, []string{pid}, false); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	objDir := filepath.Join(dir, "objects", sanitizePID(pid))
+	if _, err := os.Stat(filepath.Join(objDir, "object.json")); err != nil {
+		t.Fatalf("object.json missing: %v", err)
+	}
+	textContent, err := os.ReadFile(filepath.Join(objDir, "datastreams", "TEXT.xml"))
+	if err != nil {
+		t.Fatalf("TEXT.xml missing: %v", err)
+	}
+	if string(textContent) != "hello, export" {
+		t.Fatalf("TEXT.xml content = %q, want %q", textContent, "hello, export")
+	}
+	if _, err := os.Stat(filepath.Join(objDir, "datastreams", "BIN.bin")); err != nil {
+		t.Fatalf("BIN.bin missing: %v", err)
+	}
+
+	manifestData, err := os.ReadFile(filepath.Join(dir, "manifest-sha256.txt"))
+	if err != nil {
+		t.Fatalf("manifest-sha256.txt missing: %v", err)
+	}
+	// object.json, TEXT.json, TEXT.xml, BIN.json, BIN.bin
+	if got := bytes.Count(manifestData, []byte("\n")); got != 5 {
+		t.Fatalf("manifest has %d lines, want 5:\n%s", got, manifestData)
+	}
+
+	_, dstRemote := newFakeFedora(t)
+	if err := Import(context.Background(), dstRemote, dir, false); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+
+	got, err := FetchOneObject(context.Background(), dstRemote, pid)
+	if err != nil {
+		t.Fatalf("FetchOneObject after import: %v", err)
+	}
+	if got.Label != "a test object" {
+		t.Fatalf("imported Label = %q, want %q", got.Label, "a test object")
+	}
+	if len(got.DSitems) != 2 {
+		t.Fatalf("imported object has %d datastreams, want 2", len(got.DSitems))
+	}
+	for _, ds := range got.DSitems {
+		body, err := dstRemote.GetDatastream(context.Background(), pid, ds.Name)
+		if err != nil {
+			t.Fatalf("GetDatastream for %s: %v", ds.Name, err)
+		}
+		content, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatalf("reading %s: %v", ds.Name, err)
+		}
+		switch ds.Name {
+		case "TEXT":
+			if string(content) != "hello, export" {
+				t.Errorf("imported TEXT = %q, want %q", content, "hello, export")
+			}
+		case "BIN":
+			if !bytes.Equal(content, []byte{0x00, 0xff, 0x10, 0x20}) {
+				t.Errorf("imported BIN = %v, want %v", content, []byte{0x00, 0xff, 0x10, 0x20})
+			}
+		}
+	}
+}
@@ -0,0 +1,600 @@
+// Package f3cp holds the object model and dump/load/search logic for
+// copying objects between a Fedora 3 repository and JSON. cmd/f3cp is a
+// thin flag-parsing wrapper around this package; everything here is safe
+// for other Go programs to import directly.
+package f3cp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/dbrower/f3cp/pkg/fedora"
+)
+
+// sniffLen is how many bytes of a datastream we buffer up front to decide
+// whether its content is valid UTF-8 text (and can be emitted as a plain
+// JSON string) or should be treated as opaque binary (and base64 encoded).
+// This mirrors the buffer-then-MultiReader trick used to sniff image
+// formats: we never need to hold more than sniffLen bytes plus whatever the
+// caller has already read back out.
+const sniffLen = 512
+
+type FObject struct {
+	fedora.ObjectInfo
+	DSitems []DSentry
+}
+
+// DSentry carries a datastream's metadata plus, when decoded from JSON, its
+// still-encoded content. Content and ContentBase64 are kept as raw JSON
+// string tokens (quotes and all) rather than decoded Go strings/[]byte, so
+// that UploadOneObject can turn them into an io.Reader without requiring a
+// second full-size copy of the datastream body. Exactly one of the two may
+// be set; both are empty if the datastream has no content.
+type DSentry struct {
+	fedora.DsInfo
+	Content       json.RawMessage `json:",omitempty"`
+	ContentBase64 json.RawMessage `json:",omitempty"`
+}
+
+// Source returns an io.Reader over this entry's datastream content, or nil
+// if the entry has none. ContentBase64 is decoded as it is read, so large
+// binary datastreams never need to be held in memory as a second copy.
+// Content is JSON-unescaped up front: encoding/json has already buffered the
+// whole token by the time UnmarshalJSON sees it, so there is nothing left to
+// gain by also streaming the unescape step, and textual datastreams (e.g.
+// RELS-EXT, DC) tend to be small regardless.
+func (d DSentry) Source() (io.Reader, error) {
+	switch {
+	case len(d.ContentBase64) > 0:
+		raw := bytes.Trim(d.ContentBase64, `"`)
+		return base64.NewDecoder(base64.StdEncoding, bytes.NewReader(raw)), nil
+	case len(d.Content) > 0:
+		var s string
+		if err := json.Unmarshal(d.Content, &s); err != nil {
+			return nil, err
+		}
+		return bytes.NewReader([]byte(s)), nil
+	default:
+		return nil, nil
+	}
+}
+
+// DumpOptions controls how Dump and Search fetch and write objects.
+type DumpOptions struct {
+	// Concurrency is the number of objects fetched from remote in parallel.
+	// Values less than 1 are treated as 1, fetching one object at a time.
+	Concurrency int
+	// NoVerify disables checksum verification of fetched datastream
+	// content against the Checksum fedora reports for it.
+	NoVerify bool
+	// Progress, if non-nil, is called instead of printing a status line to
+	// STDERR: once with a nil err as each object's fetch starts, and once
+	// more with the error if fetching or writing that object fails.
+	// When Concurrency is greater than 1, Progress is called concurrently
+	// from multiple worker goroutines (once per in-flight fetch) and must
+	// be safe for that; serialize internally (e.g. with a mutex) if the
+	// callback itself isn't.
+	Progress func(pid string, err error)
+}
+
+func (o DumpOptions) report(pid string, err error) {
+	if o.Progress != nil {
+		o.Progress(pid, err)
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, pid, err)
+	} else {
+		fmt.Fprintln(os.Stderr, "dumping", pid)
+	}
+}
+
+// Dump fetches ids from remote and writes them to out as a well-formed JSON
+// array, in the order given, regardless of the order in which the fetches
+// (possibly run in parallel; see DumpOptions.Concurrency) complete. If ctx
+// is canceled, it stops fetching further objects, and requests to remote
+// still outstanding (including datastream content requests) fail with
+// ctx's error. If writing any one object to out fails partway through,
+// Dump writes nothing after that object but the closing bracket and
+// returns that error; the failed object is left partially written at the
+// end of out.
+func Dump(ctx context.Context, remote *fedora.RemoteFedora, out io.Writer, ids []string, opts DumpOptions) error {
+	pids := make(chan string)
+	go func() {
+		defer close(pids)
+		for _, id := range ids {
+			select {
+			case pids <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return dumpPIDs(ctx, remote, out, pids, opts)
+}
+
+// dumpJob is one unit of work for the dumpPIDs worker pool: fetch the
+// metadata for id, remembering its position in the input order.
+type dumpJob struct {
+	index int
+	id    string
+}
+
+// dumpResult is a completed dumpJob, ready to be written out once it is
+// its turn.
+type dumpResult struct {
+	index int
+	id    string
+	obj   *FObject
+	err   error
+}
+
+// dumpPIDs fetches the metadata for every pid sent on pids using a pool of
+// opts.Concurrency workers, then writes the resulting objects to out as a
+// JSON array in the order pids were received -- not the order the fetches
+// finished in. Only one object's datastream content is streamed to out at a
+// time, so memory use does not grow with concurrency. If writing an object
+// to out fails, dumpPIDs stops writing any further objects and returns that
+// error; the truncated object stays as the last entry of the array.
+func dumpPIDs(ctx context.Context, remote *fedora.RemoteFedora, out io.Writer, pids <-chan string, opts DumpOptions) error {
+	n := opts.Concurrency
+	if n < 1 {
+		n = 1
+	}
+
+	// A failed write must stop the whole dump rather than leave a broken
+	// object sitting in the middle of the array, so cancel ctx the moment
+	// one occurs: that stops further fetches while we drain the in-flight
+	// results without writing anything more.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan dumpJob)
+	results := make(chan dumpResult)
+
+	var workers sync.WaitGroup
+	workers.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				opts.report(j.id, nil)
+				obj, err := FetchOneObject(ctx, remote, j.id)
+				results <- dumpResult{index: j.index, id: j.id, obj: obj, err: err}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+	go func() {
+		i := 0
+		for id := range pids {
+			jobs <- dumpJob{index: i, id: id}
+			i++
+		}
+		close(jobs)
+	}()
+
+	// Results can arrive out of order, so hold each one in pending until
+	// every result before it has been written.
+	pending := make(map[int]dumpResult)
+	next := 0
+	fmt.Fprintf(out, "[")
+	first := true
+	var writeErr error
+	for res := range results {
+		pending[res.index] = res
+		for {
+			r, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if writeErr != nil {
+				// A previous object's write already failed; drain the
+				// remaining in-order results without writing any more of
+				// them, so we don't keep appending after a broken entry.
+				continue
+			}
+			if r.err != nil {
+				opts.report(r.id, r.err)
+				continue
+			}
+			if !first {
+				fmt.Fprintf(out, ",")
+			}
+			first = false
+			if err := writeFObject(ctx, out, remote, r.obj, !opts.NoVerify); err != nil {
+				opts.report(r.id, err)
+				writeErr = err
+				cancel()
+			}
+		}
+	}
+	fmt.Fprintf(out, "]")
+	if writeErr != nil {
+		return writeErr
+	}
+	return ctx.Err()
+}
+
+// FetchOneObject loads the metadata for id from remote: the object's info
+// and, for each of its datastreams, the DsInfo. Datastream content is not
+// fetched here; writeFObject streams it directly from remote into the
+// output writer so that a single large datastream never has to be held in
+// memory in full.
+func FetchOneObject(ctx context.Context, remote *fedora.RemoteFedora, id string) (*FObject, error) {
+	var err error
+	result := FObject{}
+	result.ObjectInfo, err = remote.GetObjectInfo(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	dsNames, err := remote.GetDatastreamList(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	// load the datastreams in alphabetical order
+	sort.StringSlice(dsNames).Sort()
+	for _, ds := range dsNames {
+		var entry DSentry
+		entry.DsInfo, err = remote.GetDatastreamInfo(ctx, id, ds)
+		if err != nil {
+			return nil, err
+		}
+		result.DSitems = append(result.DSitems, entry)
+	}
+	return &result, nil
+}
+
+// writeFObject writes obj to w as a single JSON object, fetching and
+// streaming each datastream's content from remote as it is encoded. The
+// ObjectInfo and DsInfo metadata are marshaled normally (they are small and
+// fixed-size); only the datastream bodies are streamed. When verify is
+// true, each datastream's content is checked against the Checksum fedora
+// reported for it as it streams by.
+func writeFObject(ctx context.Context, w io.Writer, remote *fedora.RemoteFedora, obj *FObject, verify bool) error {
+	head, err := json.Marshal(obj.ObjectInfo)
+	if err != nil {
+		return err
+	}
+	// head is a complete `{...}` object; splice "DSitems" in before the
+	// closing brace rather than re-marshaling the whole FObject at once.
+	if _, err := w.Write(head[:len(head)-1]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, `,"DSitems":[`); err != nil {
+		return err
+	}
+	for i, ds := range obj.DSitems {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := writeDSentry(ctx, w, remote, obj.PID, ds, verify); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "]}")
+	return err
+}
+
+// writeDSentry writes a single datastream's metadata and, if it has any
+// content, fetches the content from remote and streams it straight into w
+// as either a plain JSON string (valid UTF-8 text) or a base64 JSON string
+// (everything else). When verify is true and fedora has a Checksum on
+// record for the datastream, the streamed bytes are hashed and checked
+// against it; a mismatch is returned as an error once the stream is fully
+// read.
+func writeDSentry(ctx context.Context, w io.Writer, remote *fedora.RemoteFedora, id string, ds DSentry, verify bool) error {
+	head, err := json.Marshal(ds.DsInfo)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(head[:len(head)-1]); err != nil {
+		return err
+	}
+	if ds.Size > 0 {
+		body, err := remote.GetDatastream(ctx, id, ds.Name)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		isText, content, err := sniffUTF8(body)
+		if err != nil {
+			return err
+		}
+		content = io.LimitReader(content, ds.Size)
+		if verify {
+			content, err = newVerifyingReader(content, ds.ChecksumType, ds.Checksum)
+			if err != nil {
+				return err
+			}
+		}
+		if isText {
+			if _, err := io.WriteString(w, `,"Content":`); err != nil {
+				return err
+			}
+			if err := writeJSONString(w, content); err != nil {
+				return err
+			}
+		} else {
+			if _, err := io.WriteString(w, `,"ContentBase64":`); err != nil {
+				return err
+			}
+			if err := writeJSONBase64String(w, content); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = io.WriteString(w, "}")
+	return err
+}
+
+// sniffUTF8 reads up to sniffLen bytes from r to decide whether the stream
+// looks like valid UTF-8 text, then returns that same decision along with a
+// reader that reproduces the full, untouched stream (sniffed prefix plus
+// whatever is left of r).
+func sniffUTF8(r io.Reader) (isText bool, full io.Reader, err error) {
+	var prefix bytes.Buffer
+	_, err = io.CopyN(&prefix, r, sniffLen)
+	if err != nil && err != io.EOF {
+		return false, nil, err
+	}
+	return utf8.Valid(prefix.Bytes()), io.MultiReader(&prefix, r), nil
+}
+
+// writeJSONString copies r into w as a quoted, escaped JSON string.
+func writeJSONString(w io.Writer, r io.Reader) error {
+	if _, err := io.WriteString(w, `"`); err != nil {
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			if err := writeJSONEscaped(w, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	_, err := io.WriteString(w, `"`)
+	return err
+}
+
+// writeJSONEscaped writes b into w with the minimal escaping JSON strings
+// require (quote, backslash, and control characters).
+func writeJSONEscaped(w io.Writer, b []byte) error {
+	start := 0
+	for i, c := range b {
+		if c >= 0x20 && c != '"' && c != '\\' {
+			continue
+		}
+		if _, err := w.Write(b[start:i]); err != nil {
+			return err
+		}
+		var esc string
+		switch c {
+		case '"':
+			esc = `\"`
+		case '\\':
+			esc = `\\`
+		case '\n':
+			esc = `\n`
+		case '\r':
+			esc = `\r`
+		case '\t':
+			esc = `\t`
+		default:
+			esc = fmt.Sprintf(`\u%04x`, c)
+		}
+		if _, err := io.WriteString(w, esc); err != nil {
+			return err
+		}
+		start = i + 1
+	}
+	_, err := w.Write(b[start:])
+	return err
+}
+
+// writeJSONBase64String copies r into w as a quoted JSON string containing
+// the standard base64 encoding of r's bytes. Because the base64 alphabet
+// never needs JSON escaping, this can encode straight from the reader into
+// w without any intermediate buffering of the full content.
+func writeJSONBase64String(w io.Writer, r io.Reader) error {
+	if _, err := io.WriteString(w, `"`); err != nil {
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := io.Copy(enc, r); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, `"`)
+	return err
+}
+
+// Search runs pattern against remote and writes every matching object to
+// out, in the same well-formed JSON array form as Dump. Useful patterns are
+// `pid~something*` to match all PIDs that have a given prefix, and
+// `pid~prefix:* mDate>2020-11-25T06:01:15` to get all items matching a
+// prefix and having a modified date later than November 25, 2020 at
+// 6:01:15. The pattern is passed to fedora 3 unchanged, so refer to the
+// fedora documentation for more.
+//
+// Search result pages are requested as the previous page's pids are still
+// being fetched, so the first objects start downloading before the last
+// search page has even been requested.
+func Search(ctx context.Context, remote *fedora.RemoteFedora, pattern string, out io.Writer, opts DumpOptions) error {
+	pids := make(chan string)
+	go func() {
+		defer close(pids)
+		token := ""
+		found := 0
+		for {
+			// get a page of search results
+			refs, next, err := remote.SearchObjects(ctx, pattern, token)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			for _, ref := range refs {
+				select {
+				case pids <- ref.PID:
+				case <-ctx.Done():
+					return
+				}
+			}
+			found += len(refs)
+			token = next
+			// no token is returned on the last results page
+			if token == "" {
+				break
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%d Items Found\n", found)
+	}()
+	return dumpPIDs(ctx, remote, out, pids, opts)
+}
+
+// LoadOptions controls how Load uploads objects.
+type LoadOptions struct {
+	// NoVerify disables checking uploaded datastream content against the
+	// Checksum declared for it in the loaded JSON.
+	NoVerify bool
+	// Progress, if non-nil, is called instead of printing a status line to
+	// STDERR: once with a nil err as each object's upload starts, and once
+	// more with the error if decoding or uploading it fails (pid is empty
+	// when the object could not be decoded).
+	Progress func(pid string, err error)
+}
+
+func (o LoadOptions) report(pid string, err error) {
+	if o.Progress != nil {
+		o.Progress(pid, err)
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, pid, err)
+	} else {
+		fmt.Fprintln(os.Stderr, "loading", pid)
+	}
+}
+
+// Load reads a JSON array written by Dump or Search from source and
+// uploads each object to remote in order, stopping at the first error.
+func Load(ctx context.Context, remote *fedora.RemoteFedora, source io.Reader, opts LoadOptions) error {
+	// read objects from json list one at a time
+	dec := json.NewDecoder(source)
+
+	// read open bracket
+	_, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	// while the array contains values
+	for dec.More() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var obj FObject
+		// decode an array value
+		err := dec.Decode(&obj)
+		if err != nil {
+			opts.report("", err)
+			return err
+		}
+
+		opts.report(obj.PID, nil)
+		err = UploadOneObject(ctx, remote, obj, !opts.NoVerify)
+		if err != nil {
+			opts.report(obj.PID, err)
+			return err
+		}
+	}
+
+	// read closing bracket
+	_, err = dec.Token()
+	return err
+}
+
+// UploadOneObject creates or updates obj and its datastreams on remote. When
+// verify is true and a datastream declares a Checksum, the content streamed
+// to fedora is hashed as it is uploaded and checked against that checksum;
+// a mismatch is reported as an error once the upload's body has been fully
+// read.
+func UploadOneObject(ctx context.Context, remote *fedora.RemoteFedora, obj FObject, verify bool) error {
+	if err := ensureObject(ctx, remote, obj.ObjectInfo); err != nil {
+		return err
+	}
+	// now upload each datastream
+	for _, ds := range obj.DSitems {
+		// skip fedora special datastreams
+		if ds.Name == "DC" {
+			continue
+		}
+		// choose the correct source for this datastream content
+		// n.b. it is possible that source will remain nil
+		// that means there is no content to upload.
+		source, err := ds.Source()
+		if err != nil {
+			return err
+		}
+		if err := uploadDatastream(ctx, remote, obj.PID, ds.DsInfo, source, verify); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureObject makes sure obj exists on remote, creating it if it doesn't.
+func ensureObject(ctx context.Context, remote *fedora.RemoteFedora, obj fedora.ObjectInfo) error {
+	_, err := remote.GetObjectInfo(ctx, obj.PID)
+	if err == fedora.ErrNotFound {
+		err = remote.MakeObject(ctx, obj)
+	}
+	return err
+}
+
+// uploadDatastream creates or updates the datastream named by info on pid,
+// reading its content from source (which may be nil for a content-less
+// datastream). When verify is true and info declares a Checksum, source is
+// hashed as it is uploaded and checked against it.
+func uploadDatastream(ctx context.Context, remote *fedora.RemoteFedora, pid string, info fedora.DsInfo, source io.Reader, verify bool) error {
+	if verify && source != nil {
+		var err error
+		source, err = newVerifyingReader(source, info.ChecksumType, info.Checksum)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := remote.GetDatastreamInfo(ctx, pid, info.Name)
+	if err == fedora.ErrNotFound {
+		err = remote.MakeDatastream(ctx, pid, info, source)
+	} else if err == nil {
+		err = remote.UpdateDatastream(ctx, pid, info, source)
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package f3cp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dbrower/f3cp/pkg/fedora"
+)
+
+// newTestRemote starts a fake Fedora server that answers GetObjectInfo and
+// GetDatastreamList for any pid with an empty datastream list, delaying the
+// object profile response for pid "slowN" by N milliseconds. This lets
+// tests force fetches to finish out of input order without any real
+// concurrency-timing flakiness.
+func newTestRemote(t *testing.T) *fedora.RemoteFedora {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/objects/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/datastreams"):
+			fmt.Fprint(w, `<objectDatastreams/>`)
+		default:
+			pid := strings.TrimPrefix(r.URL.Path, "/objects/")
+			if delay, ok := strings.CutPrefix(pid, "slow"); ok {
+				var ms int
+				fmt.Sscanf(delay, "%d", &ms)
+				time.Sleep(time.Duration(ms) * time.Millisecond)
+			}
+			fmt.Fprint(w, `<objectProfile><objLabel>`+pid+`</objLabel><objLastModDate>2020-01-01</objLastModDate></objectProfile>`)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return fedora.NewRemote(srv.URL)
+}
+
+// TestDumpPreservesInputOrder fetches a set of pids concurrently, with
+// earlier pids in the input artificially delayed so later ones finish
+// first, and checks that Dump still writes objects to out in input order.
+func TestDumpPreservesInputOrder(t *testing.T) {
+	remote := newTestRemote(t)
+	ids := []string{"slow40", "slow30", "slow20", "slow10", "slow0"}
+
+	var out strings.Builder
+	opts := DumpOptions{Concurrency: len(ids), Progress: func(string, error) {}}
+	if err := Dump(context.Background(), remote, &out, ids, opts); err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+
+	var objs []FObject
+	if err := json.Unmarshal([]byte(out.String()), &objs); err != nil {
+		t.Fatalf("output is not valid JSON: %v\n%s", err, out.String())
+	}
+	if len(objs) != len(ids) {
+		t.Fatalf("got %d objects, want %d", len(objs), len(ids))
+	}
+	for i, id := range ids {
+		if objs[i].Label != id {
+			t.Errorf("object %d = %q, want %q (output order should match input order)", i, objs[i].Label, id)
+		}
+	}
+}
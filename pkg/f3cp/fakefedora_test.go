@@ -0,0 +1,253 @@
+package f3cp
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dbrower/f3cp/pkg/fedora"
+)
+
+// fakeDatastream is one datastream held by a fakeFedora: its profile and
+// its raw content.
+type fakeDatastream struct {
+	info    fedora.DsInfo
+	content []byte
+}
+
+// fakeObject is one object held by a fakeFedora.
+type fakeObject struct {
+	info fedora.ObjectInfo
+	ds   map[string]*fakeDatastream
+}
+
+// fakeFedora is a minimal in-memory stand-in for a Fedora 3 repository,
+// just enough of the REST API for f3cp's dump/sync/export/import paths:
+// object and datastream profiles, datastream content, search-by-mDate, and
+// creating/updating objects and datastreams. It exists so sync.go and
+// export.go's failure-handling and round-trip logic can be exercised
+// without a real Fedora server.
+type fakeFedora struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	failPID map[string]bool // pids whose object profile fetch returns a 500
+}
+
+func newFakeFedora(t *testing.T) (*fakeFedora, *fedora.RemoteFedora) {
+	t.Helper()
+	f := &fakeFedora{objects: map[string]*fakeObject{}, failPID: map[string]bool{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/objects", f.handleSearch)
+	mux.HandleFunc("/objects/", f.handleObjects)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return f, fedora.NewRemote(srv.URL)
+}
+
+// put adds or replaces an object with no datastreams.
+func (f *fakeFedora) put(info fedora.ObjectInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[info.PID] = &fakeObject{info: info, ds: map[string]*fakeDatastream{}}
+}
+
+// putDatastream adds or replaces a datastream on an already-put object.
+func (f *fakeFedora) putDatastream(pid string, info fedora.DsInfo, content []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info.Size = int64(len(content))
+	f.objects[pid].ds[info.Name] = &fakeDatastream{info: info, content: content}
+}
+
+// failNext makes the next GetObjectInfo for pid return a server error,
+// simulating a transient fetch failure, then clears itself.
+func (f *fakeFedora) failNext(pid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failPID[pid] = true
+}
+
+func (f *fakeFedora) handleSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("query")
+	threshold := ""
+	if i := strings.Index(q, "mDate>"); i >= 0 {
+		threshold = strings.TrimSpace(q[i+len("mDate>"):])
+	}
+
+	f.mu.Lock()
+	var pids []string
+	for pid := range f.objects {
+		pids = append(pids, pid)
+	}
+	sort.Strings(pids)
+	type resultObj struct {
+		PID   string `xml:"pid"`
+		MDate string `xml:"mDate"`
+	}
+	var objs []resultObj
+	for _, pid := range pids {
+		o := f.objects[pid]
+		if threshold != "" && o.info.MDate <= threshold {
+			continue
+		}
+		objs = append(objs, resultObj{PID: pid, MDate: o.info.MDate})
+	}
+	f.mu.Unlock()
+
+	type result struct {
+		XMLName xml.Name    `xml:"result"`
+		Objects []resultObj `xml:"resultList>objectFields"`
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result{Objects: objs})
+}
+
+func (f *fakeFedora) handleObjects(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/objects/")
+	parts := strings.Split(rest, "/")
+	pid := parts[0]
+	switch {
+	case len(parts) == 1:
+		f.handleObjectProfile(w, r, pid)
+	case len(parts) == 2 && parts[1] == "datastreams":
+		f.handleDatastreamList(w, r, pid)
+	case len(parts) == 3 && parts[1] == "datastreams":
+		f.handleDatastreamInfo(w, r, pid, parts[2])
+	case len(parts) == 4 && parts[1] == "datastreams" && parts[3] == "content":
+		f.handleDatastreamContent(w, pid, parts[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeFedora) handleObjectProfile(w http.ResponseWriter, r *http.Request, pid string) {
+	if r.Method == http.MethodPost {
+		f.put(fedora.ObjectInfo{PID: pid, Label: r.URL.Query().Get("label")})
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	f.mu.Lock()
+	o, ok := f.objects[pid]
+	fail := f.failPID[pid]
+	delete(f.failPID, pid)
+	f.mu.Unlock()
+
+	if fail {
+		http.Error(w, "simulated failure", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	type objectProfile struct {
+		XMLName xml.Name `xml:"objectProfile"`
+		Label   string   `xml:"objLabel"`
+		State   string   `xml:"objState"`
+		OwnerID string   `xml:"objOwnerId"`
+		CDate   string   `xml:"objCreateDate"`
+		MDate   string   `xml:"objLastModDate"`
+	}
+	xml.NewEncoder(w).Encode(objectProfile{
+		Label: o.info.Label, State: o.info.State, OwnerID: o.info.OwnerID,
+		CDate: o.info.CDate, MDate: o.info.MDate,
+	})
+}
+
+func (f *fakeFedora) handleDatastreamList(w http.ResponseWriter, r *http.Request, pid string) {
+	f.mu.Lock()
+	o, ok := f.objects[pid]
+	var names []string
+	if ok {
+		for name := range o.ds {
+			names = append(names, name)
+		}
+	}
+	f.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	sort.Strings(names)
+
+	type dsElem struct {
+		DsID string `xml:"dsid,attr"`
+	}
+	type list struct {
+		XMLName     xml.Name `xml:"objectDatastreams"`
+		Datastreams []dsElem `xml:"datastream"`
+	}
+	var out list
+	for _, n := range names {
+		out.Datastreams = append(out.Datastreams, dsElem{DsID: n})
+	}
+	xml.NewEncoder(w).Encode(out)
+}
+
+func (f *fakeFedora) handleDatastreamInfo(w http.ResponseWriter, r *http.Request, pid, name string) {
+	f.mu.Lock()
+	o, ok := f.objects[pid]
+	f.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		body, _ := io.ReadAll(r.Body)
+		info := fedora.DsInfo{
+			Name:         name,
+			Label:        r.URL.Query().Get("dsLabel"),
+			MIMEType:     r.URL.Query().Get("mimeType"),
+			ChecksumType: r.URL.Query().Get("checksumType"),
+			Checksum:     r.URL.Query().Get("checksum"),
+		}
+		f.mu.Lock()
+		o.ds[name] = &fakeDatastream{info: info, content: body}
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	f.mu.Lock()
+	ds, ok := o.ds[name]
+	f.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	type dsProfile struct {
+		XMLName      xml.Name `xml:"datastreamProfile"`
+		Label        string   `xml:"dsLabel"`
+		State        string   `xml:"dsState"`
+		MIMEType     string   `xml:"dsMIME"`
+		ControlGroup string   `xml:"dsControlGroup"`
+		Size         int64    `xml:"dsSize"`
+		Checksum     string   `xml:"dsChecksum"`
+		ChecksumType string   `xml:"dsChecksumType"`
+		CreateDate   string   `xml:"dsCreateDate"`
+	}
+	xml.NewEncoder(w).Encode(dsProfile{
+		Label: ds.info.Label, State: ds.info.State, MIMEType: ds.info.MIMEType,
+		ControlGroup: ds.info.ControlGroup, Size: ds.info.Size, Checksum: ds.info.Checksum,
+		ChecksumType: ds.info.ChecksumType, CreateDate: ds.info.CreateDate,
+	})
+}
+
+func (f *fakeFedora) handleDatastreamContent(w http.ResponseWriter, pid, name string) {
+	f.mu.Lock()
+	var content []byte
+	if o, ok := f.objects[pid]; ok {
+		if ds, ok := o.ds[name]; ok {
+			content = ds.content
+		}
+	}
+	f.mu.Unlock()
+	w.Write(content)
+}
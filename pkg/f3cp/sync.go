@@ -0,0 +1,366 @@
+package f3cp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dbrower/f3cp/pkg/fedora"
+)
+
+// SyncOptions controls an f3cp sync run.
+type SyncOptions struct {
+	// Prune removes the local copy of objects that no longer appear in a
+	// full remote scan. Without it, such objects are only reported on
+	// STDERR.
+	Prune bool
+	// NoVerify disables checksum verification of fetched datastream
+	// content against the Checksum fedora reports for it.
+	NoVerify bool
+}
+
+// SyncManifest records enough state about a previous `f3cp sync` run to let
+// the next run fetch only what changed: the newest mDate seen across every
+// synced object (so the next search can ask fedora for "mDate>LastSync"
+// instead of re-listing everything), and per object the checksum of each of
+// its datastreams, so unchanged datastreams don't need to be re-downloaded.
+type SyncManifest struct {
+	LastSync string
+	Objects  map[string]SyncObjectState
+}
+
+// SyncObjectState is the last-synced state of a single object.
+type SyncObjectState struct {
+	MDate       string
+	Datastreams map[string]string // datastream name -> Checksum
+}
+
+const manifestName = "manifest.json"
+
+func manifestPath(dir string) string {
+	return filepath.Join(dir, manifestName)
+}
+
+func objectsDir(dir string) string {
+	return filepath.Join(dir, "objects")
+}
+
+func objectPath(dir, pid string) string {
+	return filepath.Join(objectsDir(dir), sanitizePID(pid)+".json")
+}
+
+// sanitizePID turns a PID such as "test:123" into a string safe to use as a
+// file name on every platform f3cp runs on.
+func sanitizePID(pid string) string {
+	return strings.NewReplacer(":", "_", "/", "_").Replace(pid)
+}
+
+// loadManifest reads the manifest from dir, returning an empty manifest if
+// this is the first sync into dir.
+func loadManifest(dir string) (*SyncManifest, error) {
+	data, err := ioutil.ReadFile(manifestPath(dir))
+	if os.IsNotExist(err) {
+		return &SyncManifest{Objects: map[string]SyncObjectState{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m SyncManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if m.Objects == nil {
+		m.Objects = map[string]SyncObjectState{}
+	}
+	return &m, nil
+}
+
+// save writes m to dir's manifest file atomically, by writing to a
+// temporary file in the same directory and renaming it into place, so a
+// sync interrupted mid-write never leaves a corrupt manifest behind.
+func (m *SyncManifest) save(dir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicWriteFile(manifestPath(dir), data)
+}
+
+func atomicWriteFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Sync brings dir up to date with remote: it fetches every object whose
+// mDate is newer than the last sync, reusing dir's on-disk copy of any
+// datastream whose checksum hasn't changed, and records the new state in
+// dir's manifest after every object so an interrupted sync can pick up
+// where it left off on the next run. Objects that existed locally but are
+// no longer found by a full remote scan are reported on STDERR, and removed
+// only if opts.Prune is set.
+func Sync(ctx context.Context, remote *fedora.RemoteFedora, dir string, opts SyncOptions) error {
+	if err := os.MkdirAll(objectsDir(dir), 0777); err != nil {
+		return err
+	}
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	pattern := "pid~*"
+	if manifest.LastSync != "" {
+		pattern = fmt.Sprintf("pid~* mDate>%s", manifest.LastSync)
+	}
+	refs, err := searchAll(ctx, remote, pattern)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d changed objects\n", len(refs))
+
+	// Sync oldest mDate first, and once any object fails, stop advancing
+	// manifest.LastSync for the rest of the batch. Otherwise a transient
+	// failure on one object followed by a later-mDate object succeeding
+	// would push LastSync past the failed object's mDate, and the next
+	// run's "mDate>LastSync" search would never see it again.
+	sort.Slice(refs, func(i, j int) bool { return refs[i].MDate < refs[j].MDate })
+	canAdvance := true
+	for _, ref := range refs {
+		if err := syncOneObject(ctx, remote, dir, manifest, ref.PID, !opts.NoVerify, canAdvance); err != nil {
+			fmt.Fprintln(os.Stderr, ref.PID, err)
+			canAdvance = false
+			continue
+		}
+		if err := manifest.save(dir); err != nil {
+			return err
+		}
+	}
+
+	return reportDeleted(ctx, remote, dir, manifest, opts)
+}
+
+// searchAll pages through every result of pattern and returns the full
+// list of matching objects.
+func searchAll(ctx context.Context, remote *fedora.RemoteFedora, pattern string) ([]fedora.ObjectRef, error) {
+	var refs []fedora.ObjectRef
+	token := ""
+	for {
+		page, next, err := remote.SearchObjects(ctx, pattern, token)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, page...)
+		token = next
+		if token == "" {
+			break
+		}
+	}
+	return refs, nil
+}
+
+// syncOneObject fetches id's current metadata, writes its JSON file under
+// dir, reusing the previous sync's copy of any datastream whose checksum is
+// unchanged, and updates manifest in place to reflect the new state.
+// manifest.LastSync is only advanced when canAdvance is true; the caller
+// sets it to false once anything in the current batch has failed, so a
+// later-mDate success can never push LastSync past an object that still
+// needs to be retried.
+func syncOneObject(ctx context.Context, remote *fedora.RemoteFedora, dir string, manifest *SyncManifest, id string, verify, canAdvance bool) error {
+	obj, err := FetchOneObject(ctx, remote, id)
+	if err != nil {
+		return err
+	}
+
+	var old *FObject
+	if prev, wasSynced := manifest.Objects[id]; wasSynced && hasUnchangedDatastream(prev, obj) {
+		old, _ = readObjectFile(objectPath(dir, id))
+	}
+
+	fmt.Fprintln(os.Stderr, "syncing", id)
+	tmp, err := ioutil.TempFile(objectsDir(dir), sanitizePID(id)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeFObjectSync(ctx, tmp, remote, obj, old, verify); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), objectPath(dir, id)); err != nil {
+		return err
+	}
+
+	state := SyncObjectState{MDate: obj.MDate, Datastreams: map[string]string{}}
+	for _, ds := range obj.DSitems {
+		state.Datastreams[ds.Name] = ds.Checksum
+	}
+	manifest.Objects[id] = state
+	if canAdvance && obj.MDate > manifest.LastSync {
+		manifest.LastSync = obj.MDate
+	}
+	return nil
+}
+
+func readObjectFile(path string) (*FObject, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var obj FObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+// writeFObjectSync is writeFObject with one addition: for any datastream
+// whose checksum matches what was recorded for it in old, the previously
+// synced content is copied across instead of being re-fetched from remote.
+func writeFObjectSync(ctx context.Context, w io.Writer, remote *fedora.RemoteFedora, obj *FObject, old *FObject, verify bool) error {
+	head, err := json.Marshal(obj.ObjectInfo)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(head[:len(head)-1]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, `,"DSitems":[`); err != nil {
+		return err
+	}
+	for i, ds := range obj.DSitems {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if cached := findUnchangedDatastream(old, ds); cached != nil {
+			fmt.Fprintln(os.Stderr, "  unchanged datastream", ds.Name)
+			if err := writeDSentryCached(w, ds.DsInfo, *cached); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeDSentry(ctx, w, remote, obj.PID, ds, verify); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "]}")
+	return err
+}
+
+// hasUnchangedDatastream reports whether any of obj's datastreams has a
+// checksum matching what prev (the manifest state from the last sync)
+// recorded for a datastream of the same name. It lets syncOneObject decide
+// whether reading and parsing the previous sync's on-disk copy of obj is
+// worth doing at all, without that cost when nothing could be reused.
+func hasUnchangedDatastream(prev SyncObjectState, obj *FObject) bool {
+	for _, ds := range obj.DSitems {
+		if ds.Checksum != "" && prev.Datastreams[ds.Name] == ds.Checksum {
+			return true
+		}
+	}
+	return false
+}
+
+// findUnchangedDatastream returns old's copy of ds if old has a datastream
+// of the same name with a matching, non-empty checksum.
+func findUnchangedDatastream(old *FObject, ds DSentry) *DSentry {
+	if old == nil || ds.Checksum == "" {
+		return nil
+	}
+	for _, o := range old.DSitems {
+		if o.Name == ds.Name && o.Checksum == ds.Checksum {
+			return &o
+		}
+	}
+	return nil
+}
+
+// writeDSentryCached writes a datastream entry using info for the metadata
+// (in case it changed even though the content didn't) and cached's already
+// JSON-encoded content, without re-fetching or re-encoding anything.
+func writeDSentryCached(w io.Writer, info fedora.DsInfo, cached DSentry) error {
+	head, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(head[:len(head)-1]); err != nil {
+		return err
+	}
+	switch {
+	case len(cached.Content) > 0:
+		if _, err := io.WriteString(w, `,"Content":`); err != nil {
+			return err
+		}
+		if _, err := w.Write(cached.Content); err != nil {
+			return err
+		}
+	case len(cached.ContentBase64) > 0:
+		if _, err := io.WriteString(w, `,"ContentBase64":`); err != nil {
+			return err
+		}
+		if _, err := w.Write(cached.ContentBase64); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "}")
+	return err
+}
+
+// reportDeleted does a full, unfiltered pid~* scan and compares it against
+// manifest to find objects that were synced before but no longer exist
+// remotely. They are always reported; they are only removed from dir and
+// the manifest when opts.Prune is set.
+func reportDeleted(ctx context.Context, remote *fedora.RemoteFedora, dir string, manifest *SyncManifest, opts SyncOptions) error {
+	current, err := searchAll(ctx, remote, "pid~*")
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(current))
+	for _, ref := range current {
+		seen[ref.PID] = true
+	}
+
+	var deleted []string
+	for id := range manifest.Objects {
+		if !seen[id] {
+			deleted = append(deleted, id)
+		}
+	}
+	sort.Strings(deleted)
+
+	for _, id := range deleted {
+		if !opts.Prune {
+			fmt.Fprintln(os.Stderr, "missing remotely (use -prune to remove):", id)
+			continue
+		}
+		fmt.Fprintln(os.Stderr, "pruning", id)
+		if err := os.Remove(objectPath(dir, id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(manifest.Objects, id)
+	}
+	if opts.Prune && len(deleted) > 0 {
+		return manifest.save(dir)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package f3cp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dbrower/f3cp/pkg/fedora"
+)
+
+// TestSyncDoesNotAdvanceLastSyncPastAFailedObject reproduces the scenario
+// where the search returns a later-mDate object, which succeeds, ahead of
+// an earlier-mDate object that fails: LastSync must not be pushed past the
+// failed object's mDate, or the next sync's "mDate>LastSync" search would
+// never see it again.
+func TestSyncDoesNotAdvanceLastSyncPastAFailedObject(t *testing.T) {
+	fake, remote := newFakeFedora(t)
+	const (
+		pidEarly = "test:zzz" // earlier mDate, but alphabetically last
+		pidLate  = "test:aaa" // later mDate, but alphabetically first
+	)
+	fake.put(fedora.ObjectInfo{PID: pidEarly, MDate: "2020-01-01T00:00:00Z"})
+	fake.put(fedora.ObjectInfo{PID: pidLate, MDate: "2020-01-02T00:00:00Z"})
+	fake.failNext(pidEarly)
+
+	dir := t.TempDir()
+	if err := Sync(context.Background(), remote, dir, SyncOptions{}); err != nil {
+		t.Fatalf("first Sync: %v", err)
+	}
+
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		t.Fatalf("loadManifest: %v", err)
+	}
+	if _, ok := manifest.Objects[pidEarly]; ok {
+		t.Fatalf("%s should not be recorded as synced, its fetch failed", pidEarly)
+	}
+	if _, ok := manifest.Objects[pidLate]; !ok {
+		t.Fatalf("%s should have synced successfully", pidLate)
+	}
+	if manifest.LastSync != "" {
+		t.Fatalf("LastSync = %q, want unchanged (empty): advancing it would make the next sync's mDate>LastSync search skip %s permanently", manifest.LastSync, pidEarly)
+	}
+
+	// Second sync, this time with no failures: the previously-failed
+	// object must still be found and synced.
+	if err := Sync(context.Background(), remote, dir, SyncOptions{}); err != nil {
+		t.Fatalf("second Sync: %v", err)
+	}
+	manifest, err = loadManifest(dir)
+	if err != nil {
+		t.Fatalf("loadManifest: %v", err)
+	}
+	if _, ok := manifest.Objects[pidEarly]; !ok {
+		t.Fatalf("%s was never retried and synced on the second run", pidEarly)
+	}
+	if manifest.LastSync != "2020-01-02T00:00:00Z" {
+		t.Fatalf("LastSync = %q, want the latest mDate once everything has synced", manifest.LastSync)
+	}
+}
+
+// TestSyncReusesUnchangedDatastream checks that a datastream whose checksum
+// hasn't changed between syncs is copied from the previous sync's on-disk
+// file rather than re-fetched from remote.
+func TestSyncReusesUnchangedDatastream(t *testing.T) {
+	fake, remote := newFakeFedora(t)
+	const pid = "test:ds"
+	fake.put(fedora.ObjectInfo{PID: pid, MDate: "2020-01-01T00:00:00Z"})
+	fake.putDatastream(pid, fedora.DsInfo{Name: "TEXT", ChecksumType: "SHA-256", Checksum: "deadbeef"}, []byte("hello"))
+
+	dir := t.TempDir()
+	if err := Sync(context.Background(), remote, dir, SyncOptions{NoVerify: true}); err != nil {
+		t.Fatalf("first Sync: %v", err)
+	}
+
+	obj, err := readObjectFile(objectPath(dir, pid))
+	if err != nil {
+		t.Fatalf("readObjectFile: %v", err)
+	}
+	if len(obj.DSitems) != 1 {
+		t.Fatalf("got %d datastreams, want 1", len(obj.DSitems))
+	}
+
+	// Bump the object's mDate (as if something else about it changed) but
+	// leave the datastream's checksum the same, and serve different content
+	// under it so the test fails if sync re-fetches it from remote.
+	fake.put(fedora.ObjectInfo{PID: pid, MDate: "2020-01-02T00:00:00Z"})
+	fake.putDatastream(pid, fedora.DsInfo{Name: "TEXT", ChecksumType: "SHA-256", Checksum: "deadbeef"}, []byte("HELLO"))
+
+	if err := Sync(context.Background(), remote, dir, SyncOptions{NoVerify: true}); err != nil {
+		t.Fatalf("second Sync: %v", err)
+	}
+	obj, err = readObjectFile(objectPath(dir, pid))
+	if err != nil {
+		t.Fatalf("readObjectFile: %v", err)
+	}
+	if len(obj.DSitems) != 1 {
+		t.Fatalf("got %d datastreams after resync, want 1", len(obj.DSitems))
+	}
+	src, err := obj.DSitems[0].Source()
+	if err != nil {
+		t.Fatalf("Source: %v", err)
+	}
+	var buf [16]byte
+	n, _ := src.Read(buf[:])
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("content = %q, want %q", buf[:n], "hello")
+	}
+}
+
+// TestSyncPrune checks that an object missing from a full remote scan is
+// reported but kept unless opts.Prune is set, and removed (from disk and
+// the manifest) when it is.
+func TestSyncPrune(t *testing.T) {
+	fake, remote := newFakeFedora(t)
+	const pid = "test:gone"
+	fake.put(fedora.ObjectInfo{PID: pid, MDate: "2020-01-01T00:00:00Z"})
+
+	dir := t.TempDir()
+	if err := Sync(context.Background(), remote, dir, SyncOptions{}); err != nil {
+		t.Fatalf("first Sync: %v", err)
+	}
+	if _, err := readObjectFile(objectPath(dir, pid)); err != nil {
+		t.Fatalf("object file missing after first sync: %v", err)
+	}
+
+	// The object disappears from remote entirely.
+	fake.mu.Lock()
+	delete(fake.objects, pid)
+	fake.mu.Unlock()
+
+	if err := Sync(context.Background(), remote, dir, SyncOptions{}); err != nil {
+		t.Fatalf("second Sync (no prune): %v", err)
+	}
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		t.Fatalf("loadManifest: %v", err)
+	}
+	if _, ok := manifest.Objects[pid]; !ok {
+		t.Fatalf("%s should still be recorded without -prune", pid)
+	}
+
+	if err := Sync(context.Background(), remote, dir, SyncOptions{Prune: true}); err != nil {
+		t.Fatalf("third Sync (prune): %v", err)
+	}
+	manifest, err = loadManifest(dir)
+	if err != nil {
+		t.Fatalf("loadManifest: %v", err)
+	}
+	if _, ok := manifest.Objects[pid]; ok {
+		t.Fatalf("%s should have been pruned from the manifest", pid)
+	}
+	if _, err := readObjectFile(objectPath(dir, pid)); err == nil {
+		t.Fatalf("%s's object file should have been removed by -prune", pid)
+	}
+}